@@ -0,0 +1,29 @@
+package updater
+
+// assetName builds the canonical clash.meta release asset name for a given
+// target, e.g. "clash.meta-linux-amd64", "clash.meta-linux-armv7",
+// "clash.meta-linux-mipsle-softfloat", or "clash.meta-windows-amd64.exe".
+//
+// goarm only affects goarch "arm" and gomips only affects the "mips"
+// family; both are ignored otherwise, the same way `go build` ignores
+// GOARM/GOMIPS for architectures they don't apply to.
+func assetName(goos, goarch, goarm, gomips string) string {
+	name := "clash.meta-" + goos + "-" + goarch
+
+	switch goarch {
+	case "arm":
+		if goarm != "" {
+			name += "v" + goarm
+		}
+	case "mips", "mipsle", "mips64", "mips64le":
+		if gomips != "" {
+			name += "-" + gomips
+		}
+	}
+
+	if goos == "windows" {
+		name += ".exe"
+	}
+
+	return name
+}
@@ -0,0 +1,42 @@
+package updater
+
+import "testing"
+
+func TestAssetName(t *testing.T) {
+	testCases := []struct {
+		goos   string
+		goarch string
+		goarm  string
+		gomips string
+		want   string
+	}{
+		{goos: "linux", goarch: "amd64", want: "clash.meta-linux-amd64"},
+		{goos: "linux", goarch: "386", want: "clash.meta-linux-386"},
+		{goos: "linux", goarch: "arm", goarm: "5", want: "clash.meta-linux-armv5"},
+		{goos: "linux", goarch: "arm", goarm: "6", want: "clash.meta-linux-armv6"},
+		{goos: "linux", goarch: "arm", goarm: "7", want: "clash.meta-linux-armv7"},
+		{goos: "linux", goarch: "arm64", want: "clash.meta-linux-arm64"},
+		{goos: "linux", goarch: "mips", gomips: "hardfloat", want: "clash.meta-linux-mips-hardfloat"},
+		{goos: "linux", goarch: "mips", gomips: "softfloat", want: "clash.meta-linux-mips-softfloat"},
+		{goos: "linux", goarch: "mips64", gomips: "hardfloat", want: "clash.meta-linux-mips64-hardfloat"},
+		{goos: "linux", goarch: "mipsle", gomips: "softfloat", want: "clash.meta-linux-mipsle-softfloat"},
+		{goos: "darwin", goarch: "amd64", want: "clash.meta-darwin-amd64"},
+		{goos: "darwin", goarch: "arm64", want: "clash.meta-darwin-arm64"},
+		{goos: "windows", goarch: "amd64", want: "clash.meta-windows-amd64.exe"},
+		{goos: "windows", goarch: "386", want: "clash.meta-windows-386.exe"},
+		{goos: "windows", goarch: "arm64", want: "clash.meta-windows-arm64.exe"},
+		{goos: "freebsd", goarch: "amd64", want: "clash.meta-freebsd-amd64"},
+		{goos: "freebsd", goarch: "386", want: "clash.meta-freebsd-386"},
+		{goos: "freebsd", goarch: "arm64", want: "clash.meta-freebsd-arm64"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			got := assetName(tc.goos, tc.goarch, tc.goarm, tc.gomips)
+			if got != tc.want {
+				t.Errorf("assetName(%q, %q, %q, %q) = %q, want %q",
+					tc.goos, tc.goarch, tc.goarm, tc.gomips, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package updater
+
+import "fmt"
+
+// delayedMoveFile has no equivalent outside Windows; a live rename should
+// always succeed there, so this is only reached on unexpected failure.
+func delayedMoveFile(src, dst string) error {
+	return fmt.Errorf("delayed move is only supported on windows")
+}
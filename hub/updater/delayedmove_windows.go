@@ -0,0 +1,22 @@
+//go:build windows
+
+package updater
+
+import "golang.org/x/sys/windows"
+
+// delayedMoveFile schedules src to be moved to dst the next time Windows
+// reboots, for use when the running executable can't be replaced live
+// because it's still mapped into memory.
+func delayedMoveFile(src, dst string) error {
+	srcPtr, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+
+	dstPtr, err := windows.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+
+	return windows.MoveFileEx(srcPtr, dstPtr, windows.MOVEFILE_DELAY_UNTIL_REBOOT)
+}
@@ -0,0 +1,115 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Dreamacro/clash/log"
+
+	"github.com/gabstv/go-bsdiff/pkg/bspatch"
+)
+
+// patchKeyPrefix is the manifest key prefix used for bsdiff patches, e.g.
+// "patch_from_v1.14.2_linux_amd64".
+const patchKeyPrefix = "patch_from_"
+
+// patchInfo describes a single bsdiff patch entry from the version
+// manifest: where to fetch it, and the SHA-256 of the executable it
+// produces once applied.
+type patchInfo struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// patchKey builds the manifest key for a bsdiff patch from oldVersion to
+// the current release, for the given target.
+func patchKey(oldVersion, targetGOOS, targetGOARCH string) string {
+	return fmt.Sprintf("%s%s_%s_%s", patchKeyPrefix, oldVersion, targetGOOS, targetGOARCH)
+}
+
+// tryPatchUpdate attempts to produce the new executable via a bsdiff patch
+// against the currently running binary instead of downloading the full
+// archive.  It reports ok=false (with a nil error) whenever no matching
+// patch is advertised, so the caller can fall back to the full-archive
+// path; a non-nil error means a patch was found but failed to apply.
+func tryPatchUpdate(ctx context.Context, vi VersionInfo) (ok bool, err error) {
+	key := patchKey(version, effectiveGOOS(), effectiveGOARCH())
+
+	patch, found := vi.Patches[key]
+	if !found {
+		return false, nil
+	}
+
+	log.Infoln("updater: applying bsdiff patch %s", key)
+
+	patchBytes, err := getURLBytesCtx(ctx, patch.URL)
+	if err != nil {
+		return false, fmt.Errorf("downloading patch: %w", err)
+	}
+
+	oldExeBytes, err := os.ReadFile(currentExeName)
+	if err != nil {
+		return false, fmt.Errorf("reading current executable: %w", err)
+	}
+
+	newExeBytes, err := bspatch.Bytes(oldExeBytes, patchBytes)
+	if err != nil {
+		return false, fmt.Errorf("applying patch: %w", err)
+	}
+
+	if err = os.MkdirAll(updateDir, 0o755); err != nil {
+		return false, fmt.Errorf("mkdir updateDir: %w", err)
+	}
+
+	if err = os.WriteFile(updateExeName, newExeBytes, 0o755); err != nil {
+		return false, fmt.Errorf("writing patched executable: %w", err)
+	}
+
+	gotSum := sha256Bytes(newExeBytes)
+	if !strings.EqualFold(gotSum, patch.SHA256) {
+		return false, fmt.Errorf("patched executable sha256 mismatch: want %q, got %q", patch.SHA256, gotSum)
+	}
+
+	if err = verifyPatchedExe(gotSum); err != nil {
+		return false, fmt.Errorf("verifying patched executable: %w", err)
+	}
+
+	log.Infoln("updater: patch applied and verified")
+
+	return true, nil
+}
+
+// verifyPatchedExe checks gotSum, the sha256 of the just-produced patched
+// executable, against the minisign-signed SHA256SUMS file.  patch.SHA256
+// alone is not enough to trust: it comes from the unsigned version.json
+// manifest, so an attacker who can tamper with the manifest host could ship
+// a malicious patch alongside a matching (but unsigned) sum. Only a sum
+// that also appears in the signed SHA256SUMS may be trusted before the
+// patched binary is handed to backup/replace.
+//
+// Unlike verifyPackage, which looks up the downloaded archive by its
+// archive file name, this looks up the raw executable by its assetName —
+// SHA256SUMS carries a distinct, signed entry for each target's raw binary
+// precisely so a patch result can be verified without unpacking an archive.
+// See the sumsFileName doc comment for the full entry-naming contract.
+func verifyPatchedExe(gotSum string) error {
+	sums, err := fetchVerifiedSums()
+	if err != nil {
+		return err
+	}
+
+	name := assetName(effectiveGOOS(), effectiveGOARCH(), goarm, gomips)
+
+	wantSum, err := findSum(sums, name)
+	if err != nil {
+		return fmt.Errorf("looking up sum for %q: %w", name, err)
+	}
+
+	if !strings.EqualFold(wantSum, gotSum) {
+		return fmt.Errorf("sha256 mismatch for %q: signed sum %q, got %q", name, wantSum, gotSum)
+	}
+
+	return nil
+}
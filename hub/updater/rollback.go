@@ -0,0 +1,233 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/Dreamacro/clash/log"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// stateFileName is the name of the file persisted in updateDir that records
+// enough information to roll back an update that crashed partway through.
+const stateFileName = "state.json"
+
+// selfTestTimeout bounds how long the newly-swapped-in binary is given to
+// pass its self-test before it is considered broken.
+const selfTestTimeout = 10 * time.Second
+
+// updateState is the on-disk record written just before replace() swaps the
+// executables, so that Rollback can recover even across a crash.
+type updateState struct {
+	PreviousVersion string   `json:"previous_version"`
+	CurrentExeName  string   `json:"current_exe_name"`
+	BackupExeName   string   `json:"backup_exe_name"`
+	BackupDir       string   `json:"backup_dir"`
+	UnpackedFiles   []string `json:"unpacked_files"`
+}
+
+// saveState persists the current update state to updateDir/state.json so
+// that Rollback can restore the previous binary even if the process dies
+// before selfTest runs.
+func saveState() error {
+	st := updateState{
+		PreviousVersion: version,
+		CurrentExeName:  currentExeName,
+		BackupExeName:   backupExeName,
+		BackupDir:       backupDir,
+		UnpackedFiles:   unpackedFiles,
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+
+	return os.WriteFile(filepath.Join(updateDir, stateFileName), b, 0o644)
+}
+
+// loadState reads back the state saved by saveState.
+func loadState() (st updateState, err error) {
+	b, err := os.ReadFile(filepath.Join(updateDir, stateFileName))
+	if err != nil {
+		return updateState{}, fmt.Errorf("reading state file: %w", err)
+	}
+
+	if err = json.Unmarshal(b, &st); err != nil {
+		return updateState{}, fmt.Errorf("unmarshaling state: %w", err)
+	}
+
+	return st, nil
+}
+
+// Rollback restores the previously running binary and its supporting files
+// from backupDir.  It is safe to call after a crash mid-update, since it
+// reads the state recorded by saveState rather than relying on in-memory
+// fields.
+func Rollback() (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if updateDir == "" {
+		// No Update has run in this process, so derive updateDir from the
+		// executable path the same way RecoverIfNeeded does.
+		execPath, exErr := os.Executable()
+		if exErr != nil {
+			return fmt.Errorf("getting executable path: %w", exErr)
+		}
+
+		updateDir = filepath.Join(filepath.Dir(execPath), updateDirName)
+		defer func() { updateDir = "" }()
+	}
+
+	st, err := loadState()
+	if err != nil {
+		return fmt.Errorf("loading update state: %w", err)
+	}
+
+	log.Infoln("updater: rolling back to %s", st.PreviousVersion)
+
+	if err = restoreFromState(st); err != nil {
+		return err
+	}
+
+	log.Infoln("updater: rollback finished")
+
+	return nil
+}
+
+// RecoverIfNeeded checks updateDir (derived from execPath) for a leftover
+// state.json and, if one exists, restores the backed-up binary and
+// supporting files it describes.  It is meant to be called early at
+// startup so an update that crashed between saveState and the removal of
+// state.json is rolled back automatically instead of leaving the host on a
+// half-swapped install.
+func RecoverIfNeeded(execPath string) (err error) {
+	ud := filepath.Join(filepath.Dir(execPath), updateDirName)
+
+	if _, statErr := os.Stat(filepath.Join(ud, stateFileName)); statErr != nil {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	prevUpdateDir := updateDir
+	updateDir = ud
+	defer func() { updateDir = prevUpdateDir }()
+
+	st, err := loadState()
+	if err != nil {
+		return fmt.Errorf("loading update state: %w", err)
+	}
+
+	if _, statErr := os.Stat(st.BackupExeName); statErr != nil {
+		log.Errorln("updater: stale state file points at missing backup %q, discarding it", st.BackupExeName)
+
+		return removeState()
+	}
+
+	log.Infoln("updater: found leftover update state, recovering to %s", st.PreviousVersion)
+
+	if err = restoreFromState(st); err != nil {
+		return err
+	}
+
+	if err = removeState(); err != nil {
+		return err
+	}
+
+	log.Infoln("updater: recovery finished")
+
+	return nil
+}
+
+// restoreFromState restores both the executable and its supporting files
+// described by st, the same restoration Rollback and verifySwap rely on.
+func restoreFromState(st updateState) error {
+	if err := restoreExe(st.BackupExeName, st.CurrentExeName); err != nil {
+		return fmt.Errorf("restoring executable: %w", err)
+	}
+
+	err := copySupportingFiles(st.UnpackedFiles, st.BackupDir, filepath.Dir(st.CurrentExeName))
+	if err != nil {
+		return fmt.Errorf("restoring supporting files: %w", err)
+	}
+
+	return nil
+}
+
+// removeState deletes updateDir/state.json.  It is a no-op if the file does
+// not exist, since that just means there is nothing left to clean up.
+func removeState() error {
+	err := os.Remove(filepath.Join(updateDir, stateFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing state file: %w", err)
+	}
+
+	return nil
+}
+
+// restoreExe moves backupExe back to exeName, falling back to a copy when a
+// live rename isn't possible (e.g. the file is still in use on Windows).
+func restoreExe(backupExe, exeName string) error {
+	err := os.Rename(backupExe, exeName)
+	if err == nil {
+		return nil
+	}
+
+	return copyFile(backupExe, exeName)
+}
+
+// selfTest spawns exeName with a "-v" subcommand and waits for it to exit
+// successfully within selfTestTimeout.  It is used to verify a freshly
+// swapped-in binary actually starts before the backup is discarded.
+func selfTest(exeName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, exeName, "-v")
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("self-test timed out after %s", selfTestTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("self-test failed: %w (output: %s)", err, out)
+	}
+
+	return nil
+}
+
+// verifySwap runs selfTest against the just-installed binary and rolls back
+// automatically if it fails, returning the self-test error wrapped so
+// callers know the update did not stick.  On success, it removes the state
+// file saved before replace(), since there is nothing left to roll back.
+func verifySwap() error {
+	err := selfTest(currentExeName)
+	if err == nil {
+		if rmErr := removeState(); rmErr != nil {
+			return fmt.Errorf("removing state after successful update: %w", rmErr)
+		}
+
+		return nil
+	}
+
+	log.Errorln("updater: self-test failed, rolling back: %v", err)
+
+	st, loadErr := loadState()
+	if loadErr != nil {
+		return fmt.Errorf("self-test failed (%w) and loading state for rollback also failed: %w", err, loadErr)
+	}
+
+	if rbErr := restoreFromState(st); rbErr != nil {
+		return fmt.Errorf("self-test failed (%w) and rollback also failed: %w", err, rbErr)
+	}
+
+	return fmt.Errorf("self-test failed, rolled back to previous version: %w", err)
+}
@@ -4,12 +4,12 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +19,10 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 )
 
+// updateDirName is the name of the working directory (relative to workDir)
+// where the downloaded package is unpacked and update state is recorded.
+const updateDirName = "meta-updater"
+
 // Updater is the AdGuard Home updater.
 var (
 	client http.Client
@@ -34,6 +38,27 @@ var (
 	confName        string
 	versionCheckURL string
 
+	// trustedPubKeys holds the pinned Ed25519/minisign public keys used to
+	// verify SHA256SUMS before a downloaded package is trusted.
+	trustedPubKeys [][]byte
+	// sumsURL is the URL of the SHA256SUMS file published alongside the
+	// release archives.  It is derived from the resolved download URL on
+	// each Update, unless pinnedSumsURL overrides it.
+	sumsURL string
+	// pinnedSumsURL is Config.SumsURL, as set by Configure.  When non-empty,
+	// it takes precedence over the URL Update would otherwise derive so a
+	// caller can pin SHA256SUMS to a location other than the release host.
+	pinnedSumsURL string
+
+	// progressFunc, if set, is called as the package archive is downloaded.
+	progressFunc ProgressFunc
+
+	// prevPackageETag and prevPackageModified cache the validators returned
+	// for packageURL, so a re-run of Update can skip the download entirely
+	// via a conditional GET.
+	prevPackageETag     string
+	prevPackageModified string
+
 	// mu protects all fields below.
 	mu sync.RWMutex
 
@@ -51,9 +76,9 @@ var (
 	packageURL string
 
 	// Cached fields to prevent too many API requests.
-	prevCheckError error
-	prevCheckTime  time.Time
-	//prevCheckResult VersionInfo
+	prevCheckError  error
+	prevCheckTime   time.Time
+	prevCheckResult VersionInfo
 )
 
 // Config is the AdGuard Home updater configuration.
@@ -72,14 +97,105 @@ type Config struct {
 	ConfName string
 	// WorkDir is the working directory that is used for temporary files.
 	WorkDir string
+
+	// TrustedPubKeys are the pinned Ed25519/minisign public keys (32 raw
+	// bytes each) that a release's SHA256SUMS signature must match.  An
+	// update is refused unless at least one key verifies the signature.
+	TrustedPubKeys [][]byte
+	// SumsURL is the URL of the SHA256SUMS file for the release.  The
+	// detached minisign signature is expected at SumsURL + ".minisig".  If
+	// left empty, Update derives it from the resolved download URL's
+	// directory instead.
+	SumsURL string
+
+	// ProgressFunc, if set, is called periodically while the package
+	// archive downloads.
+	ProgressFunc ProgressFunc
+}
+
+// ProgressFunc reports download progress: bytesDone is how much has been
+// read so far and bytesTotal is the size from the response's
+// Content-Length, or -1 if the server didn't send one.
+type ProgressFunc func(bytesDone, bytesTotal int64)
+
+// SetProgressFunc sets the callback used to report download progress.
+func SetProgressFunc(fn ProgressFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	progressFunc = fn
+}
+
+// Configure applies cfg, overriding the package-level defaults used by
+// Update and CheckUpdate.  In particular, GOOS/GOARCH/GOARM/GOMIPS let a
+// host update a different target than the one it's currently running,
+// which matters for e.g. a management node updating a router.
+func Configure(cfg Config) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg.Client != nil {
+		client = *cfg.Client
+	}
+
+	version = cfg.Version
+	channel = cfg.Channel
+	goarch = cfg.GOARCH
+	goos = cfg.GOOS
+	goarm = cfg.GOARM
+	gomips = cfg.GOMIPS
+
+	confName = cfg.ConfName
+	workDir = cfg.WorkDir
+
+	trustedPubKeys = cfg.TrustedPubKeys
+	pinnedSumsURL = cfg.SumsURL
+	progressFunc = cfg.ProgressFunc
 }
 
 // Update performs the auto-updater.  It returns an error if the updater failed.
 // If firstRun is true, it assumes the configuration file doesn't exist.
-func Update(firstRun bool) (err error) {
+// Canceling ctx aborts an in-flight version check, patch download or package
+// download, and stops the update before unpack, backup or replace starts;
+// the SHA256SUMS download and an unpack already under way do not observe it.
+func Update(ctx context.Context, firstRun bool) (err error) {
+	// CheckUpdate takes mu itself, so it must run before we grab the lock
+	// below.
+	vi, err := CheckUpdate(ctx)
+	if err != nil {
+		return fmt.Errorf("checking for update: %w", err)
+	}
+
+	if err = checkSelfUpdateAllowed(version, vi); err != nil {
+		return err
+	}
+
+	resolvedURL, err := resolveDownloadURL(vi)
+	if err != nil {
+		return fmt.Errorf("resolving download url: %w", err)
+	}
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting executable path: %w", err)
+	}
+
+	// RecoverIfNeeded takes mu itself, so it must run before we grab the
+	// lock below.  It rolls back a leftover state.json from an update that
+	// crashed mid-swap, so this run starts from a clean, known-good binary.
+	if err = RecoverIfNeeded(execPath); err != nil {
+		return fmt.Errorf("recovering from previous update: %w", err)
+	}
+
 	mu.Lock()
 	defer mu.Unlock()
-	packageURL = "https://github.com/MetaCubeX/Clash.Meta/releases/download/v1.14.2/clash.meta-windows-amd64-v1.14.2.zip"
+	newVersion = vi.Version
+	packageURL = resolvedURL
+	if pinnedSumsURL != "" {
+		sumsURL = pinnedSumsURL
+	} else {
+		sumsURL = resolvedURL[:strings.LastIndex(resolvedURL, "/")+1] + sumsFileName
+	}
 
 	log.Infoln("updater: updating")
 	defer func() {
@@ -90,11 +206,6 @@ func Update(firstRun bool) (err error) {
 		}
 	}()
 
-	execPath, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("getting executable path: %w", err)
-	}
-
 	workDir = filepath.Dir(execPath)
 	log.Debugln("workDir %s", execPath)
 
@@ -105,26 +216,58 @@ func Update(firstRun bool) (err error) {
 
 	//defer clean()
 
-	err = downloadPackageFile()
+	patched, err := tryPatchUpdate(ctx, vi)
 	if err != nil {
-		return fmt.Errorf("downloading package file: %w", err)
+		log.Infoln("updater: patch update failed, falling back to full archive: %v", err)
+
+		patched = false
 	}
 
-	err = unpack()
-	if err != nil {
-		return fmt.Errorf("unpacking: %w", err)
+	if patched {
+		unpackedFiles = nil
+	} else {
+		var skipped bool
+		skipped, err = downloadPackageFile(ctx)
+		if err != nil {
+			return fmt.Errorf("downloading package file: %w", err)
+		}
+		if skipped {
+			log.Infoln("updater: package unchanged since last check (304), nothing to do")
+
+			return nil
+		}
+
+		err = verifyPackage()
+		if err != nil {
+			return fmt.Errorf("verifying package: %w", err)
+		}
+
+		err = unpack(ctx)
+		if err != nil {
+			return fmt.Errorf("unpacking: %w", err)
+		}
 	}
 
-	err = backup(firstRun)
+	err = backup(ctx, firstRun)
 	if err != nil {
 		return fmt.Errorf("making backup: %w", err)
 	}
 
-	err = replace()
+	err = saveState()
+	if err != nil {
+		return fmt.Errorf("saving update state: %w", err)
+	}
+
+	err = replace(ctx)
 	if err != nil {
 		return fmt.Errorf("replacing: %w", err)
 	}
 
+	err = verifySwap()
+	if err != nil {
+		return fmt.Errorf("verifying swap: %w", err)
+	}
+
 	return nil
 }
 
@@ -138,7 +281,7 @@ func VersionCheckURL() (vcu string) {
 
 // prepare fills all necessary fields in Updater object.
 func prepare(exePath string) (err error) {
-	updateDir = filepath.Join(workDir, "meta-updater")
+	updateDir = filepath.Join(workDir, updateDirName)
 
 	_, pkgNameOnly := filepath.Split(packageURL)
 	if pkgNameOnly == "" {
@@ -149,12 +292,7 @@ func prepare(exePath string) (err error) {
 	log.Debugln(packageName)
 	backupDir = filepath.Join(workDir, "meta-backup")
 
-	goos := runtime.GOOS
-
-	if goos == "windows" {
-		updateExeName = "clash.meta-windows-amd64.exe"
-	}
-	updateExeName = "clash.meta"
+	updateExeName = assetName(effectiveGOOS(), effectiveGOARCH(), goarm, gomips)
 
 	backupExeName = filepath.Join(backupDir, filepath.Base(exePath))
 	updateExeName = filepath.Join(updateDir, updateExeName)
@@ -176,7 +314,11 @@ func prepare(exePath string) (err error) {
 }
 
 // unpack extracts the files from the downloaded archive.
-func unpack() error {
+func unpack(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	var err error
 	_, pkgNameOnly := filepath.Split(packageURL)
 
@@ -202,7 +344,11 @@ func unpack() error {
 
 // backup makes a backup of the current configuration and supporting files.  It
 // ignores the configuration file if firstRun is true.
-func backup(firstRun bool) (err error) {
+func backup(ctx context.Context, firstRun bool) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
 	log.Debugln("updater: backing up current configuration")
 	_ = os.Mkdir(backupDir, 0777)
 
@@ -217,7 +363,11 @@ func backup(firstRun bool) (err error) {
 
 // replace moves the current executable with the updated one and also copies the
 // supporting files.
-func replace() error {
+func replace(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	err := copySupportingFiles(unpackedFiles, updateDir, workDir)
 	if err != nil {
 		return fmt.Errorf("copySupportingFiles(%s, %s) failed: %w", updateDir, workDir, err)
@@ -229,9 +379,15 @@ func replace() error {
 		return err
 	}
 
-	if goos == "windows" {
+	if effectiveGOOS() == "windows" {
 		// rename fails with "File in use" error
 		err = copyFile(updateExeName, currentExeName)
+		if err != nil {
+			// The running binary can't be overwritten while it's still
+			// mapped into memory.  Schedule the swap for the next reboot
+			// instead of failing the update outright.
+			err = delayedMoveFile(updateExeName, currentExeName)
+		}
 	} else {
 		err = os.Rename(updateExeName, currentExeName)
 	}
@@ -252,49 +408,121 @@ func clean() {
 // approximately 9 MiB.
 const MaxPackageFileSize = 32 * 1024 * 1024
 
-// Download package file and save it to disk
-func downloadPackageFile() (err error) {
-	var resp *http.Response
-	resp, err = client.Get(packageURL)
+// Download package file and stream it straight to disk, never buffering the
+// whole archive in memory.  It reports progress through progressFunc, if
+// set, and returns skipped=true without touching packageName if the server
+// answers a conditional GET with 304 Not Modified.
+func downloadPackageFile(ctx context.Context) (skipped bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, packageURL, nil)
 	if err != nil {
-		return fmt.Errorf("http request failed: %w", err)
+		return false, fmt.Errorf("building request: %w", err)
+	}
+
+	if prevPackageETag != "" {
+		req.Header.Set("If-None-Match", prevPackageETag)
+	}
+	if prevPackageModified != "" {
+		req.Header.Set("If-Modified-Since", prevPackageModified)
 	}
-	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
 
-	var r io.Reader
-	r, err = LimitReader(resp.Body, MaxPackageFileSize)
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("http request failed: %w", err)
+		return false, fmt.Errorf("http request failed: %w", err)
 	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
 
-	log.Debugln("updater: reading http body")
-	// This use of ReadAll is now safe, because we limited body's Reader.
-	body, err := io.ReadAll(r)
+	if resp.StatusCode == http.StatusNotModified {
+		return true, nil
+	}
+
+	prevPackageETag = resp.Header.Get("ETag")
+	prevPackageModified = resp.Header.Get("Last-Modified")
+
+	total := resp.ContentLength
+
+	r, err := LimitReader(resp.Body, MaxPackageFileSize)
 	if err != nil {
-		return fmt.Errorf("io.ReadAll() failed: %w", err)
+		return false, fmt.Errorf("http request failed: %w", err)
 	}
 
 	log.Debugln("updateDir %s", updateDir)
 	err = os.Mkdir(updateDir, 0o755)
-	if err != nil {
-		fmt.Errorf("mkdir error: %w", err)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return false, fmt.Errorf("mkdir error: %w", err)
 	}
 
 	log.Debugln("updater: saving package to file", packageName)
-	err = os.WriteFile(packageName, body, 0o755)
+	out, err := os.OpenFile(packageName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
 	if err != nil {
-		return fmt.Errorf("os.WriteFile() failed: %w", err)
+		return false, fmt.Errorf("os.OpenFile() failed: %w", err)
 	}
-	return nil
+	defer func() { err = errors.WithDeferred(err, out.Close()) }()
+
+	log.Debugln("updater: reading http body")
+	if _, err = io.Copy(out, newProgressReader(r, total)); err != nil {
+		return false, fmt.Errorf("io.Copy() failed: %w", err)
+	}
+
+	return false, nil
+}
+
+// newProgressReader wraps r in a TeeReader that reports cumulative bytes
+// read to progressFunc, if one is configured.  total is normally the
+// response's Content-Length, or -1 if the server didn't send one.
+func newProgressReader(r io.Reader, total int64) io.Reader {
+	if progressFunc == nil {
+		return r
+	}
+
+	var done int64
+
+	return io.TeeReader(r, progressWriterFunc(func(p []byte) (int, error) {
+		done += int64(len(p))
+		progressFunc(done, total)
+
+		return len(p), nil
+	}))
+}
+
+// progressWriterFunc adapts a func to an io.Writer for use as the sink half
+// of the TeeReader in newProgressReader.
+type progressWriterFunc func(p []byte) (int, error)
+
+func (f progressWriterFunc) Write(p []byte) (int, error) { return f(p) }
+
+// maxUnpackedFileSize is the maximum number of bytes read from a single
+// archive entry.
+const maxUnpackedFileSize = 64 * 1024 * 1024
+
+// maxUnpackedTotalSize is the maximum cumulative number of bytes read from
+// all entries of a single archive, guarding against gzip/zip bombs whose
+// individual entries each stay under maxUnpackedFileSize.
+const maxUnpackedTotalSize = 256 * 1024 * 1024
+
+// safeJoin joins outDir and name and makes sure the result doesn't escape
+// outDir, defending against zip-slip-style archive entries.
+func safeJoin(outDir, name string) (string, error) {
+	outputName := filepath.Join(outDir, name)
+
+	cleanOutDir := filepath.Clean(outDir) + string(filepath.Separator)
+	cleanOutput := filepath.Clean(outputName)
+	if !strings.HasPrefix(cleanOutput+string(filepath.Separator), cleanOutDir) {
+		return "", fmt.Errorf("entry %q escapes output directory %q", name, outDir)
+	}
+
+	return outputName, nil
 }
 
-func tarGzFileUnpackOne(outDir string, tr *tar.Reader, hdr *tar.Header) (name string, err error) {
+func tarGzFileUnpackOne(outDir string, tr *tar.Reader, hdr *tar.Header, totalRead *int64) (name string, err error) {
 	name = filepath.Base(hdr.Name)
 	if name == "" {
 		return "", nil
 	}
 
-	outputName := filepath.Join(outDir, name)
+	outputName, err := safeJoin(outDir, name)
+	if err != nil {
+		return "", err
+	}
 
 	if hdr.Typeflag == tar.TypeDir {
 		if name == "AdGuardHome" {
@@ -316,6 +544,12 @@ func tarGzFileUnpackOne(outDir string, tr *tar.Reader, hdr *tar.Header) (name st
 		return "", nil
 	}
 
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		log.Infoln("updater: %s: rejecting link entry", name)
+
+		return "", nil
+	}
+
 	if hdr.Typeflag != tar.TypeReg {
 		log.Infoln("updater: %s: unknown file type %d, skipping", name, hdr.Typeflag)
 
@@ -333,10 +567,18 @@ func tarGzFileUnpackOne(outDir string, tr *tar.Reader, hdr *tar.Header) (name st
 	}
 	defer func() { err = errors.WithDeferred(err, wc.Close()) }()
 
-	_, err = io.Copy(wc, tr)
+	n, err := io.Copy(wc, io.LimitReader(tr, maxUnpackedFileSize+1))
 	if err != nil {
 		return "", fmt.Errorf("io.Copy(): %w", err)
 	}
+	if n > maxUnpackedFileSize {
+		return "", fmt.Errorf("%s: exceeds per-file limit of %d bytes", name, maxUnpackedFileSize)
+	}
+
+	*totalRead += n
+	if *totalRead > maxUnpackedTotalSize {
+		return "", fmt.Errorf("archive exceeds total unpacked size limit of %d bytes", maxUnpackedTotalSize)
+	}
 
 	log.Debugln("updater: created file %q", outputName)
 
@@ -361,6 +603,7 @@ func tarGzFileUnpack(tarfile, outDir string) (files []string, err error) {
 	defer func() { err = errors.WithDeferred(err, gzReader.Close()) }()
 
 	tarReader := tar.NewReader(gzReader)
+	var totalRead int64
 	for {
 		var hdr *tar.Header
 		hdr, err = tarReader.Next()
@@ -375,7 +618,10 @@ func tarGzFileUnpack(tarfile, outDir string) (files []string, err error) {
 		}
 
 		var name string
-		name, err = tarGzFileUnpackOne(outDir, tarReader, hdr)
+		name, err = tarGzFileUnpackOne(outDir, tarReader, hdr, &totalRead)
+		if err != nil {
+			break
+		}
 
 		if name != "" {
 			files = append(files, name)
@@ -385,21 +631,24 @@ func tarGzFileUnpack(tarfile, outDir string) (files []string, err error) {
 	return files, err
 }
 
-func zipFileUnpackOne(outDir string, zf *zip.File) (name string, err error) {
-	var rc io.ReadCloser
-	rc, err = zf.Open()
-	if err != nil {
-		return "", fmt.Errorf("zip file Open(): %w", err)
-	}
-	defer func() { err = errors.WithDeferred(err, rc.Close()) }()
-
+func zipFileUnpackOne(outDir string, zf *zip.File, totalRead *int64) (name string, err error) {
 	fi := zf.FileInfo()
 	name = fi.Name()
 	if name == "" {
 		return "", nil
 	}
 
-	outputName := filepath.Join(outDir, name)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		log.Infoln("updater: %s: rejecting symlink entry", name)
+
+		return "", nil
+	}
+
+	outputName, err := safeJoin(outDir, name)
+	if err != nil {
+		return "", err
+	}
+
 	if fi.IsDir() {
 		if name == "AdGuardHome" {
 			// Top-level AdGuardHome/.  Skip it.
@@ -419,6 +668,13 @@ func zipFileUnpackOne(outDir string, zf *zip.File) (name string, err error) {
 		return "", nil
 	}
 
+	var rc io.ReadCloser
+	rc, err = zf.Open()
+	if err != nil {
+		return "", fmt.Errorf("zip file Open(): %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, rc.Close()) }()
+
 	var wc io.WriteCloser
 	wc, err = os.OpenFile(outputName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
 	if err != nil {
@@ -426,10 +682,18 @@ func zipFileUnpackOne(outDir string, zf *zip.File) (name string, err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, wc.Close()) }()
 
-	_, err = io.Copy(wc, rc)
+	n, err := io.Copy(wc, io.LimitReader(rc, maxUnpackedFileSize+1))
 	if err != nil {
 		return "", fmt.Errorf("io.Copy(): %w", err)
 	}
+	if n > maxUnpackedFileSize {
+		return "", fmt.Errorf("%s: exceeds per-file limit of %d bytes", name, maxUnpackedFileSize)
+	}
+
+	*totalRead += n
+	if *totalRead > maxUnpackedTotalSize {
+		return "", fmt.Errorf("archive exceeds total unpacked size limit of %d bytes", maxUnpackedTotalSize)
+	}
 
 	log.Debugln("updater: created file %q", outputName)
 
@@ -447,9 +711,10 @@ func zipFileUnpack(zipfile, outDir string) (files []string, err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, zrc.Close()) }()
 
+	var totalRead int64
 	for _, zf := range zrc.File {
 		var name string
-		name, err = zipFileUnpackOne(outDir, zf)
+		name, err = zipFileUnpackOne(outDir, zf, &totalRead)
 		if err != nil {
 			break
 		}
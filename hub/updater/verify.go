@@ -0,0 +1,223 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dreamacro/clash/log"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// sumsFileName is the conventional name of the file containing the SHA-256
+// sums of every asset in a release, signed with minisign.
+//
+// A release's SHA256SUMS carries two classes of entries, keyed differently:
+// the published download archives, keyed by their archive file name (e.g.
+// "clash.meta-linux-amd64-v1.14.2.tar.gz", looked up via
+// filepath.Base(packageName) in verifyPackage), and the raw per-target
+// executables the archives contain (e.g. "clash.meta-linux-amd64", looked
+// up via assetName in verifyPatchedExe). The latter exist specifically so a
+// bsdiff-patched binary can be verified against a signed sum without
+// needing to unpack an archive first.
+const sumsFileName = "SHA256SUMS"
+
+// verifyPackage downloads the companion SHA256SUMS file for the release,
+// checks that the downloaded package matches the recorded sum, and verifies
+// the minisign/Ed25519 signature over SHA256SUMS against one of
+// trustedPubKeys.  It must run after downloadPackageFile and before unpack,
+// so that a tampered or unsigned archive never reaches backupDir or
+// currentExeName.
+func verifyPackage() (err error) {
+	sums, err := fetchVerifiedSums()
+	if err != nil {
+		return err
+	}
+
+	wantSum, err := findSum(sums, filepath.Base(packageName))
+	if err != nil {
+		return fmt.Errorf("looking up sum for %q: %w", packageName, err)
+	}
+
+	gotSum, err := fileSHA256(packageName)
+	if err != nil {
+		return fmt.Errorf("hashing %q: %w", packageName, err)
+	}
+
+	if !strings.EqualFold(wantSum, gotSum) {
+		return fmt.Errorf("updater: sha256 mismatch for %q: want %q, got %q", packageName, wantSum, gotSum)
+	}
+
+	log.Debugln("updater: package integrity and signature verified")
+
+	return nil
+}
+
+// fetchVerifiedSums downloads sumsURL and its detached minisign signature,
+// checks the signature against trustedPubKeys, and returns the sums file
+// contents on success.  Any caller that needs to trust a sha256 recorded in
+// SHA256SUMS, whether for the full archive or a bsdiff-patched binary, must
+// go through this rather than trusting an unsigned sum from version.json.
+func fetchVerifiedSums() (sums []byte, err error) {
+	if len(trustedPubKeys) == 0 {
+		return nil, fmt.Errorf("updater: no trusted public keys configured, refusing to verify")
+	}
+
+	sums, sig, err := downloadSumsFile()
+	if err != nil {
+		return nil, fmt.Errorf("downloading sums file: %w", err)
+	}
+
+	for _, pubKey := range trustedPubKeys {
+		if verifyMinisign(pubKey, sums, sig) {
+			return sums, nil
+		}
+	}
+
+	return nil, fmt.Errorf("updater: signature verification of %s failed", sumsFileName)
+}
+
+// downloadSumsFile fetches sumsURL and its detached minisign signature
+// (sumsURL + ".minisig").  It returns the raw contents of both files.
+func downloadSumsFile() (sums, sig []byte, err error) {
+	sums, err = getURLBytes(sumsURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting %q: %w", sumsURL, err)
+	}
+
+	sig, err = getURLBytes(sumsURL + ".minisig")
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting %q: %w", sumsURL+".minisig", err)
+	}
+
+	return sums, sig, nil
+}
+
+// getURLBytes performs a size-limited GET request and returns the body.
+func getURLBytes(url string) (b []byte, err error) {
+	return getURLBytesCtx(context.Background(), url)
+}
+
+// getURLBytesCtx is the context-aware form of getURLBytes.
+func getURLBytesCtx(ctx context.Context, url string) (b []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	var r io.Reader
+	r, err = LimitReader(resp.Body, MaxPackageFileSize)
+	if err != nil {
+		return nil, fmt.Errorf("limiting reader: %w", err)
+	}
+
+	return io.ReadAll(r)
+}
+
+// findSum returns the hex SHA-256 sum recorded for name in a GNU
+// coreutils-style "<sum>  <name>" (or "<sum> *<name>") sums file.  Lines in
+// the BSD tagged "SHA256 (<name>) = <sum>" form are not recognized.
+func findSum(sums []byte, name string) (sum string, err error) {
+	for _, line := range strings.Split(string(sums), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		fileName := strings.TrimPrefix(fields[1], "*")
+		if fileName == name {
+			return fields[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("no sum recorded for %q", name)
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 sum of the file at path.
+func fileSHA256(path string) (sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("os.Open(): %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("io.Copy(): %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Bytes returns the hex-encoded SHA-256 sum of b.
+func sha256Bytes(b []byte) string {
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// minisigPrefix is the algorithm tag used by legacy (non-prehashed)
+// minisign Ed25519 signatures.
+var minisigPrefix = [2]byte{'E', 'd'}
+
+// verifyMinisign reports whether sig is a valid minisign signature file over
+// msg for the raw 32-byte Ed25519 public key pubKey.
+//
+// It only supports the legacy "Ed" algorithm, which is sufficient for
+// signing a small SHA256SUMS file.
+func verifyMinisign(pubKey, msg, sig []byte) bool {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	sigBytes, err := decodeMinisigLine(sig)
+	if err != nil {
+		return false
+	}
+
+	// Layout: 2-byte algorithm, 8-byte key ID, 64-byte Ed25519 signature.
+	if len(sigBytes) != 2+8+ed25519.SignatureSize {
+		return false
+	}
+
+	if sigBytes[0] != minisigPrefix[0] || sigBytes[1] != minisigPrefix[1] {
+		return false
+	}
+
+	rawSig := sigBytes[10:]
+
+	return ed25519.Verify(ed25519.PublicKey(pubKey), msg, rawSig)
+}
+
+// decodeMinisigLine extracts and base64-decodes the second line of a
+// minisign ".minisig" file, which holds "untrusted comment\n<base64
+// signature>\ntrusted comment\n<base64 global signature>".
+func decodeMinisigLine(sig []byte) (decoded []byte, err error) {
+	lines := strings.Split(string(bytes.TrimSpace(sig)), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("malformed minisig file")
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+}
@@ -0,0 +1,265 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dreamacro/clash/log"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// defaultCheckPeriod is how long a successful CheckUpdate result is cached
+// for before CheckUpdate hits the network again.
+const defaultCheckPeriod = 1 * time.Hour
+
+// checkPeriod is the currently configured cache TTL for CheckUpdate.
+var checkPeriod = defaultCheckPeriod
+
+// SetCheckPeriod overrides the default TTL used to cache CheckUpdate
+// results.
+func SetCheckPeriod(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	checkPeriod = d
+}
+
+// VersionInfo is the decoded contents of the version manifest published at
+// versionCheckURL, in the spirit of AdGuard Home's version.json.
+type VersionInfo struct {
+	Version              string               `json:"version"`
+	Announcement         string               `json:"announcement"`
+	AnnouncementURL      string               `json:"announcement_url"`
+	SelfUpdateMinVersion string               `json:"selfupdate_min_version"`
+	DownloadURLs         map[string]string    `json:"-"`
+	Patches              map[string]patchInfo `json:"-"`
+}
+
+// versionManifest mirrors the wire format of the version.json file.  It is
+// unmarshaled into a map first because the "download_*" keys are dynamic.
+type versionManifest map[string]json.RawMessage
+
+// CheckUpdate fetches and parses versionCheckURL, returning the resolved
+// VersionInfo for the current release channel.  Results are cached for
+// checkPeriod to avoid hammering the server on repeated calls.
+func CheckUpdate(ctx context.Context) (vi VersionInfo, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if prevCheckError == nil && time.Since(prevCheckTime) < checkPeriod && prevCheckTime != (time.Time{}) {
+		return prevCheckResult, nil
+	}
+
+	vi, err = fetchVersionInfo(ctx)
+	prevCheckTime = time.Now()
+	prevCheckError = err
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("fetching version info: %w", err)
+	}
+
+	prevCheckResult = vi
+
+	return vi, nil
+}
+
+// fetchVersionInfo does the actual network round-trip and JSON decoding for
+// CheckUpdate.
+func fetchVersionInfo(ctx context.Context) (vi VersionInfo, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, versionCheckURL, nil)
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("http request failed: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	r, err := LimitReader(resp.Body, MaxPackageFileSize)
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("limiting reader: %w", err)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	var manifest versionManifest
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return VersionInfo{}, fmt.Errorf("unmarshaling manifest: %w", err)
+	}
+
+	vi.DownloadURLs = make(map[string]string)
+	vi.Patches = make(map[string]patchInfo)
+	for k, raw := range manifest {
+		switch {
+		case k == "version":
+			err = json.Unmarshal(raw, &vi.Version)
+		case k == "announcement":
+			err = json.Unmarshal(raw, &vi.Announcement)
+		case k == "announcement_url":
+			err = json.Unmarshal(raw, &vi.AnnouncementURL)
+		case k == "selfupdate_min_version":
+			err = json.Unmarshal(raw, &vi.SelfUpdateMinVersion)
+		case strings.HasPrefix(k, patchKeyPrefix):
+			var pi patchInfo
+			if uerr := json.Unmarshal(raw, &pi); uerr == nil {
+				vi.Patches[k] = pi
+			}
+		case strings.HasPrefix(k, "download_"):
+			var url string
+			if uerr := json.Unmarshal(raw, &url); uerr == nil {
+				vi.DownloadURLs[k] = url
+			}
+		}
+		if err != nil {
+			return VersionInfo{}, fmt.Errorf("unmarshaling %q: %w", k, err)
+		}
+	}
+
+	log.Debugln("updater: resolved version manifest: %+v", vi.Version)
+
+	return vi, nil
+}
+
+// downloadKey builds the "download_<goos>_<goarch>[v<goarm>]" (or, for the
+// mips family, "download_<goos>_<goarch>_<gomips>") manifest key for the
+// given target.
+func downloadKey(targetGOOS, targetGOARCH, targetGOARM, targetGOMIPS string) string {
+	key := fmt.Sprintf("download_%s_%s", targetGOOS, targetGOARCH)
+
+	switch targetGOARCH {
+	case "arm":
+		if targetGOARM != "" {
+			key += "v" + targetGOARM
+		}
+	case "mips", "mipsle", "mips64", "mips64le":
+		if targetGOMIPS != "" {
+			key += "_" + targetGOMIPS
+		}
+	}
+
+	return key
+}
+
+// effectiveGOARCH returns the configured target architecture, falling back
+// to the host's runtime.GOARCH when none was set via Config.
+func effectiveGOARCH() string {
+	if goarch != "" {
+		return goarch
+	}
+
+	return runtime.GOARCH
+}
+
+// effectiveGOOS returns the configured target OS, falling back to the
+// host's runtime.GOOS when none was set via Config.
+func effectiveGOOS() string {
+	if goos != "" {
+		return goos
+	}
+
+	return runtime.GOOS
+}
+
+// resolveDownloadURL picks the download URL from vi matching the target
+// given by effectiveGOOS/effectiveGOARCH (the configured GOOS/GOARCH, or the
+// host's runtime.GOOS/GOARCH when unset) and the package-level goarm/gomips.
+func resolveDownloadURL(vi VersionInfo) (url string, err error) {
+	key := downloadKey(effectiveGOOS(), effectiveGOARCH(), goarm, gomips)
+
+	url, ok := vi.DownloadURLs[key]
+	if !ok {
+		return "", fmt.Errorf("no download URL for %q in version manifest", key)
+	}
+
+	return url, nil
+}
+
+// checkSelfUpdateAllowed refuses an update when the running version is
+// older than the manifest's declared minimum self-update version.  Versions
+// that don't parse as dotted numbers (dev builds, "unknown", git-hash
+// tags) can't be compared, so the gate is skipped for them rather than
+// aborting the update.
+func checkSelfUpdateAllowed(currentVersion string, vi VersionInfo) error {
+	if vi.SelfUpdateMinVersion == "" {
+		return nil
+	}
+
+	cmp, err := compareVersions(currentVersion, vi.SelfUpdateMinVersion)
+	if err != nil {
+		log.Infoln(
+			"updater: could not compare current version %q with minimum %q, allowing update: %v",
+			currentVersion, vi.SelfUpdateMinVersion, err,
+		)
+
+		return nil
+	}
+
+	if cmp < 0 {
+		return fmt.Errorf(
+			"updater: current version %q is older than the minimum self-update version %q",
+			currentVersion, vi.SelfUpdateMinVersion,
+		)
+	}
+
+	return nil
+}
+
+// compareVersions compares two "vMAJOR.MINOR.PATCH"-style version strings,
+// returning -1, 0, or 1 the way strings.Compare does.
+func compareVersions(a, b string) (cmp int, err error) {
+	aParts, err := splitVersion(a)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %q: %w", a, err)
+	}
+
+	bParts, err := splitVersion(b)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %q: %w", b, err)
+	}
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			if aParts[i] < bParts[i] {
+				return -1, nil
+			}
+
+			return 1, nil
+		}
+	}
+
+	switch {
+	case len(aParts) < len(bParts):
+		return -1, nil
+	case len(aParts) > len(bParts):
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// splitVersion parses a "vMAJOR.MINOR.PATCH" string into its numeric parts.
+func splitVersion(v string) (parts []int, err error) {
+	v = strings.TrimPrefix(v, "v")
+	for _, s := range strings.Split(v, ".") {
+		n, cerr := strconv.Atoi(s)
+		if cerr != nil {
+			return nil, fmt.Errorf("invalid version component %q: %w", s, cerr)
+		}
+
+		parts = append(parts, n)
+	}
+
+	return parts, nil
+}